@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// constantTimeEquals compares two equal-length tokens in constant time. A
+// length mismatch is rejected up front without a byte compare, so the
+// token's length itself is not hidden from timing.
+func constantTimeEquals(a, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// AdminKeysHandler manages the client keyring: GET lists keys, POST adds or
+// updates one, DELETE revokes one by ?key=. Every request must carry a
+// matching X-Admin-Token header.
+func AdminKeysHandler(kr *ClientKeyring, adminToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" || !constantTimeEquals(r.Header.Get("X-Admin-Token"), adminToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(kr.List()); err != nil {
+				log.Printf("Error encoding client keyring: %v", err)
+			}
+
+		case http.MethodPost:
+			var ck ClientKey
+			if err := json.NewDecoder(r.Body).Decode(&ck); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			if ck.Key == "" {
+				http.Error(w, "key is required", http.StatusBadRequest)
+				return
+			}
+			if err := ck.Transform.compile(); err != nil {
+				http.Error(w, "Invalid redact_patterns: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			kr.Add(ck)
+			w.WriteHeader(http.StatusNoContent)
+
+		case http.MethodDelete:
+			key := r.URL.Query().Get("key")
+			if key == "" {
+				http.Error(w, "key query parameter is required", http.StatusBadRequest)
+				return
+			}
+			if !kr.Revoke(key) {
+				http.Error(w, "key not found", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheEntry is what gets stored for one cached completion: enough to
+// replay the original response, plus the token counts so a cache hit can
+// still be metered accurately. Model/InputTokens/OutputTokens are parsed
+// from the upstream response *before* the client's response transform
+// runs, since a transform configured with strip_response_fields may remove
+// the usage/model fields a post-transform parse would need.
+type CacheEntry struct {
+	Body         []byte
+	ContentType  string
+	Model        string
+	InputTokens  int
+	OutputTokens int
+	storedAt     time.Time
+}
+
+// ResponseCache is the interface the proxy talks to; LRUCache is the
+// built-in in-process implementation. A Redis-backed implementation can
+// satisfy the same interface without the proxy code changing.
+type ResponseCache interface {
+	Get(key string) (*CacheEntry, bool)
+	Set(key string, entry *CacheEntry, ttl time.Duration)
+}
+
+type lruNode struct {
+	key   string
+	entry *CacheEntry
+}
+
+// LRUCache is a fixed-capacity, TTL-aware in-process cache.
+type LRUCache struct {
+	mu      sync.Mutex
+	maxSize int
+	ttl     time.Duration
+	items   map[string]*list.Element
+	order   *list.List // front = most recently used
+}
+
+// NewLRUCache builds an in-process cache holding at most maxSize entries,
+// each expiring ttl after it was written.
+func NewLRUCache(maxSize int, ttl time.Duration) *LRUCache {
+	return &LRUCache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		items:   make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *LRUCache) Get(key string) (*CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	node := el.Value.(*lruNode)
+	if time.Since(node.entry.storedAt) > c.ttl {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return node.entry, true
+}
+
+func (c *LRUCache) Set(key string, entry *CacheEntry, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.storedAt = time.Now()
+	if ttl > 0 {
+		c.ttl = ttl
+	}
+
+	if el, ok := c.items[key]; ok {
+		el.Value.(*lruNode).entry = entry
+		c.order.MoveToFront(el)
+		return
+	}
+
+	el := c.order.PushFront(&lruNode{key: key, entry: entry})
+	c.items[key] = el
+
+	for c.order.Len() > c.maxSize {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruNode).key)
+	}
+}
+
+// cacheablePaths are the only routes eligible for caching: idempotent
+// completions where identical input always means identical output.
+var cacheablePaths = []string{"/v1/chat/completions", "/v1/embeddings"}
+
+func isCacheablePath(path string) bool {
+	for _, p := range cacheablePaths {
+		if strings.HasSuffix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsCache reports whether this request opts into caching: either an
+// explicit X-LLM-Cache: on header, or the default heuristic of
+// stream=false (or absent) and temperature=0.
+func wantsCache(r *http.Request, body []byte) bool {
+	if strings.EqualFold(r.Header.Get("X-LLM-Cache"), "on") {
+		return true
+	}
+
+	var payload struct {
+		Stream      *bool    `json:"stream"`
+		Temperature *float64 `json:"temperature"`
+	}
+	if json.Unmarshal(body, &payload) != nil {
+		return false
+	}
+	if payload.Stream != nil && *payload.Stream {
+		return false
+	}
+	return payload.Temperature != nil && *payload.Temperature == 0
+}
+
+// cacheKeyFields is the canonicalized subset of the request that determines
+// whether two requests should collide in the cache.
+type cacheKeyFields struct {
+	Model          string      `json:"model,omitempty"`
+	Messages       interface{} `json:"messages,omitempty"`
+	Input          interface{} `json:"input,omitempty"`
+	Tools          interface{} `json:"tools,omitempty"`
+	ResponseFormat interface{} `json:"response_format,omitempty"`
+	Seed           interface{} `json:"seed,omitempty"`
+}
+
+// cacheKey hashes the canonicalized request fields with SHA-256. body must
+// already have PII-redaction and other transforms applied so that two
+// requests which redact to the same thing collide correctly.
+func cacheKey(path string, body []byte) (string, bool) {
+	var payload map[string]interface{}
+	if json.Unmarshal(body, &payload) != nil {
+		return "", false
+	}
+
+	fields := cacheKeyFields{
+		Model:          stringField(payload, "model"),
+		Messages:       payload["messages"],
+		Input:          payload["input"],
+		Tools:          payload["tools"],
+		ResponseFormat: payload["response_format"],
+		Seed:           payload["seed"],
+	}
+	canonical, err := json.Marshal(fields)
+	if err != nil {
+		return "", false
+	}
+
+	sum := sha256.Sum256(append([]byte(path+"|"), canonical...))
+	return hex.EncodeToString(sum[:]), true
+}
@@ -4,6 +4,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -20,18 +22,75 @@ func main() {
 		port = "8080"
 	}
 
-	apiKey := os.Getenv("API_KEY")
-	if apiKey == "" {
-		log.Fatal("API_KEY environment variable is required")
+	keyringConfigPath := os.Getenv("CLIENT_KEYRING_CONFIG")
+	if keyringConfigPath == "" {
+		log.Fatal("CLIENT_KEYRING_CONFIG environment variable is required (path to the client keyring config)")
 	}
 
-	llmApiUrl := os.Getenv("LLM_API_URL")
-	if llmApiUrl == "" {
-		log.Fatal("LLM_API_URL environment variable is required")
+	keyring, err := LoadClientKeyring(keyringConfigPath)
+	if err != nil {
+		log.Fatalf("Failed to load client keyring: %v", err)
+	}
+
+	poolConfigPath := os.Getenv("LLM_POOL_CONFIG")
+	if poolConfigPath == "" {
+		log.Fatal("LLM_POOL_CONFIG environment variable is required (path to the upstream pool config)")
+	}
+
+	pool, err := NewPool(poolConfigPath)
+	if err != nil {
+		log.Fatalf("Failed to load upstream pool: %v", err)
+	}
+
+	stopHealthChecks := make(chan struct{})
+	defer close(stopHealthChecks)
+	go pool.StartHealthChecks(30*time.Second, stopHealthChecks)
+
+	stopKeyPersist := make(chan struct{})
+	defer close(stopKeyPersist)
+	for _, u := range pool.upstreams {
+		if u.keys != nil {
+			go u.keys.StartPersisting(time.Minute, stopKeyPersist)
+		}
+	}
+
+	costTablePath := os.Getenv("MODEL_COST_CONFIG")
+	var costTable CostTable
+	if costTablePath != "" {
+		costTable, err = LoadCostTable(costTablePath)
+		if err != nil {
+			log.Fatalf("Failed to load model cost table: %v", err)
+		}
+	}
+
+	limiter := NewRateLimiter()
+	metrics := NewMetrics(costTable)
+
+	var cache ResponseCache
+	cacheTTL := 10 * time.Minute
+	if os.Getenv("CACHE_ENABLED") == "true" {
+		maxEntries := 1000
+		if v := os.Getenv("CACHE_MAX_ENTRIES"); v != "" {
+			if n, err := strconv.Atoi(v); err == nil {
+				maxEntries = n
+			}
+		}
+		if v := os.Getenv("CACHE_TTL_SECONDS"); v != "" {
+			if n, err := strconv.Atoi(v); err == nil {
+				cacheTTL = time.Duration(n) * time.Second
+			}
+		}
+		cache = NewLRUCache(maxEntries, cacheTTL)
 	}
 
 	// Setup routes
-	http.HandleFunc("/api/llm/", createLLMProxyHandler(llmApiUrl, apiKey))
+	http.HandleFunc("/api/llm/", createLLMProxyHandler(pool, keyring, limiter, metrics, cache, cacheTTL))
+	http.HandleFunc("/healthz", pool.HealthzHandler)
+	http.HandleFunc("/pool", pool.PoolHandler)
+	http.HandleFunc("/metrics", metrics.Handler)
+
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	http.HandleFunc("/admin/keys", AdminKeysHandler(keyring, adminToken))
 
 	// Start the server
 	log.Printf("Middleware server starting on port %s...\n", port)
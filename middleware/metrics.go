@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+)
+
+// ModelCost is the USD cost per 1K tokens for one model, split by
+// direction so input and output can be priced independently.
+type ModelCost struct {
+	InputPer1K  float64 `json:"input_per_1k"`
+	OutputPer1K float64 `json:"output_per_1k"`
+}
+
+// CostTable maps model name to its per-token pricing.
+type CostTable map[string]ModelCost
+
+// LoadCostTable reads a JSON {"model": {"input_per_1k":.., "output_per_1k":..}}
+// file from disk.
+func LoadCostTable(path string) (CostTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading cost table: %w", err)
+	}
+	var table CostTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("parsing cost table: %w", err)
+	}
+	return table, nil
+}
+
+// USD returns the cost of n tokens of the given direction ("input" or
+// "output") for model, or 0 if the model isn't in the table.
+func (t CostTable) USD(model, direction string, n int) float64 {
+	cost, ok := t[model]
+	if !ok || n <= 0 {
+		return 0
+	}
+	perToken := cost.InputPer1K
+	if direction == "output" {
+		perToken = cost.OutputPer1K
+	}
+	return perToken / 1000 * float64(n)
+}
+
+type metricKey struct {
+	key       string
+	model     string
+	direction string
+}
+
+// Metrics accumulates the llm_tokens_total and llm_cost_usd_total counters
+// and exposes them in Prometheus text exposition format.
+type Metrics struct {
+	mu          sync.Mutex
+	cost        CostTable
+	costTotal   map[metricKey]float64
+	tokensTotal map[metricKey]float64
+}
+
+func NewMetrics(cost CostTable) *Metrics {
+	return &Metrics{
+		cost:        cost,
+		costTotal:   make(map[metricKey]float64),
+		tokensTotal: make(map[metricKey]float64),
+	}
+}
+
+// RecordUsage records n tokens of direction ("input"/"output") spent by key
+// on model, and updates the running USD cost counter for that combination.
+func (m *Metrics) RecordUsage(key, model, direction string, n int) {
+	if n <= 0 {
+		return
+	}
+	k := metricKey{key: key, model: model, direction: direction}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokensTotal[k] += float64(n)
+	m.costTotal[metricKey{key: key, model: model}] += m.cost.USD(model, direction, n)
+}
+
+// Handler renders the counters in Prometheus text exposition format.
+func (m *Metrics) Handler(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# TYPE llm_tokens_total counter")
+	for _, k := range sortedKeys(m.tokensTotal) {
+		fmt.Fprintf(w, "llm_tokens_total{key=%q,model=%q,direction=%q} %g\n", k.key, k.model, k.direction, m.tokensTotal[k])
+	}
+
+	fmt.Fprintln(w, "# TYPE llm_cost_usd_total counter")
+	for _, k := range sortedKeys(m.costTotal) {
+		fmt.Fprintf(w, "llm_cost_usd_total{key=%q,model=%q} %g\n", k.key, k.model, m.costTotal[k])
+	}
+}
+
+func sortedKeys(m map[metricKey]float64) []metricKey {
+	keys := make([]metricKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].key != keys[j].key {
+			return keys[i].key < keys[j].key
+		}
+		if keys[i].model != keys[j].model {
+			return keys[i].model < keys[j].model
+		}
+		return keys[i].direction < keys[j].direction
+	})
+	return keys
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UpstreamConfig describes one LLM provider endpoint in the pool config file.
+type UpstreamConfig struct {
+	Name    string `json:"name"`
+	BaseURL string `json:"base_url"`
+
+	// AuthType picks the default credential header when AuthHeader isn't
+	// set explicitly: "anthropic" -> x-api-key, "azure-openai" -> api-key,
+	// "openai"/"ollama" (or unset) -> Authorization: Bearer. Set AuthHeader
+	// directly to override.
+	AuthType    string            `json:"auth_type"`
+	APIKey      string            `json:"api_key"`
+	Headers     map[string]string `json:"headers"`
+	Weight      int               `json:"weight"`
+	MaxInFlight int               `json:"max_in_flight"`
+
+	// ProviderKeys, when set, rotates through multiple credentials for this
+	// upstream instead of the single static APIKey. AuthHeader names the
+	// header the chosen key is placed in (defaults per AuthType above; the
+	// "Authorization" header gets a "Bearer " prefix).
+	ProviderKeys        []ProviderKeyConfig `json:"provider_keys,omitempty"`
+	AuthHeader          string              `json:"auth_header,omitempty"`
+	KeyQuotaPersistPath string              `json:"key_quota_persist_path,omitempty"`
+}
+
+// PoolConfig is the top-level shape of the upstream pool config file. The
+// config file is JSON only: this repo takes no YAML dependency, and a
+// config written as YAML fails to load with the JSON parse error.
+type PoolConfig struct {
+	Upstreams []UpstreamConfig `json:"upstreams"`
+
+	// RetryBudget caps how many other upstreams Dispatch will try after the
+	// first failure. A pointer so an explicit 0 (no retries) is
+	// distinguishable from "not set" (falls back to defaultRetryBudget).
+	RetryBudget *int `json:"retry_budget,omitempty"`
+}
+
+// upstream is the runtime state tracked for one configured endpoint.
+type upstream struct {
+	cfg UpstreamConfig
+
+	mu            sync.Mutex
+	healthy       bool
+	cooldownUntil time.Time
+	backoff       time.Duration
+	lastRTT       time.Duration
+	lastErr       error
+
+	inFlight int64
+
+	keys *ProviderKeyPool // nil unless cfg.ProviderKeys is set
+}
+
+const (
+	minBackoff = 5 * time.Second
+	maxBackoff = 5 * time.Minute
+
+	// keyCoolDown is how long a provider key sits out after the upstream
+	// rejects it with 401 (revoked) or 429 (rate limited).
+	keyCoolDown = 60 * time.Second
+
+	// defaultRetryBudget is used when the pool config doesn't set
+	// retry_budget explicitly.
+	defaultRetryBudget = 2
+)
+
+// authHeaderForType returns the header a provider expects its credential in,
+// for upstreams that don't set auth_header explicitly. Anthropic and Azure
+// OpenAI use their own non-Authorization header names; OpenAI and Ollama
+// both take a standard Bearer token.
+func authHeaderForType(authType string) string {
+	switch authType {
+	case "anthropic":
+		return "x-api-key"
+	case "azure-openai":
+		return "api-key"
+	default: // "openai", "ollama", "" (unspecified)
+		return "Authorization"
+	}
+}
+
+func newUpstream(cfg UpstreamConfig) (*upstream, error) {
+	if cfg.Weight <= 0 {
+		cfg.Weight = 1
+	}
+	if cfg.AuthHeader == "" {
+		cfg.AuthHeader = authHeaderForType(cfg.AuthType)
+	}
+	u := &upstream{cfg: cfg, healthy: true, backoff: minBackoff}
+
+	if len(cfg.ProviderKeys) > 0 {
+		keys, err := NewProviderKeyPool(cfg.KeyQuotaPersistPath, cfg.ProviderKeys)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", cfg.Name, err)
+		}
+		u.keys = keys
+	}
+	return u, nil
+}
+
+// authHeaderValue formats a rotated provider key for cfg.AuthHeader; the
+// Authorization header needs the "Bearer " scheme, other headers (e.g.
+// Azure's "api-key") take the raw key.
+func (u *upstream) authHeaderValue(key string) string {
+	if u.cfg.AuthHeader == "Authorization" {
+		return "Bearer " + key
+	}
+	return key
+}
+
+func (u *upstream) markHealthy(rtt time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.healthy = true
+	u.backoff = minBackoff
+	u.lastRTT = rtt
+	u.lastErr = nil
+}
+
+func (u *upstream) markUnhealthy(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.healthy = false
+	u.lastErr = err
+	u.cooldownUntil = time.Now().Add(u.backoff)
+	u.backoff *= 2
+	if u.backoff > maxBackoff {
+		u.backoff = maxBackoff
+	}
+}
+
+func (u *upstream) isHealthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.healthy && time.Now().After(u.cooldownUntil) {
+		// Cooldown elapsed; let the next probe decide, but allow traffic
+		// to retry it optimistically.
+		return true
+	}
+	return u.healthy
+}
+
+func (u *upstream) snapshot() map[string]interface{} {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	errStr := ""
+	if u.lastErr != nil {
+		errStr = u.lastErr.Error()
+	}
+	return map[string]interface{}{
+		"name":           u.cfg.Name,
+		"base_url":       u.cfg.BaseURL,
+		"healthy":        u.healthy,
+		"weight":         u.cfg.Weight,
+		"rtt_ms":         u.lastRTT.Milliseconds(),
+		"in_flight":      atomic.LoadInt64(&u.inFlight),
+		"cooldown_until": u.cooldownUntil,
+		"last_error":     errStr,
+	}
+}
+
+// Pool selects among healthy upstreams by weighted random choice (see
+// selectWeighted; there is no round-robin cursor) and keeps them monitored
+// with a background health checker.
+type Pool struct {
+	mu           sync.RWMutex
+	upstreams    []*upstream
+	client       *http.Client // used for normal, buffered requests and health probes
+	streamClient *http.Client // no timeout: used for SSE/chunked streaming requests
+
+	retryBudget int
+}
+
+// NewPool builds a Pool from a JSON config file on disk (see PoolConfig;
+// JSON only, no YAML support).
+func NewPool(configPath string) (*Pool, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading pool config: %w", err)
+	}
+
+	var cfg PoolConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing pool config: %w", err)
+	}
+	if len(cfg.Upstreams) == 0 {
+		return nil, fmt.Errorf("pool config %s declares no upstreams", configPath)
+	}
+
+	retryBudget := defaultRetryBudget
+	if cfg.RetryBudget != nil {
+		retryBudget = *cfg.RetryBudget
+	}
+
+	p := &Pool{
+		client:       &http.Client{Timeout: 30 * time.Second},
+		streamClient: &http.Client{}, // no timeout; bounded by the client's own context instead
+		retryBudget:  retryBudget,
+	}
+	for _, cfg := range cfg.Upstreams {
+		u, err := newUpstream(cfg)
+		if err != nil {
+			return nil, err
+		}
+		p.upstreams = append(p.upstreams, u)
+	}
+	return p, nil
+}
+
+// StartHealthChecks launches the background prober and blocks until stop is
+// closed. Run it in its own goroutine.
+func (p *Pool) StartHealthChecks(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.probeAll()
+	for {
+		select {
+		case <-ticker.C:
+			p.probeAll()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (p *Pool) probeAll() {
+	p.mu.RLock()
+	upstreams := append([]*upstream(nil), p.upstreams...)
+	p.mu.RUnlock()
+
+	for _, u := range upstreams {
+		go p.probe(u)
+	}
+}
+
+func (p *Pool) probe(u *upstream) {
+	start := time.Now()
+	req, err := http.NewRequest(http.MethodGet, u.cfg.BaseURL+"/v1/models", nil)
+	if err != nil {
+		u.markUnhealthy(err)
+		return
+	}
+	for k, v := range u.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.Printf("health check failed for upstream %s: %v", u.cfg.Name, err)
+		u.markUnhealthy(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		err := fmt.Errorf("probe returned status %d", resp.StatusCode)
+		log.Printf("health check failed for upstream %s: %v", u.cfg.Name, err)
+		u.markUnhealthy(err)
+		return
+	}
+	u.markHealthy(time.Since(start))
+}
+
+// underCapacity reports whether u has room for another in-flight request
+// under its configured MaxInFlight. A MaxInFlight of 0 means unlimited.
+func (u *upstream) underCapacity() bool {
+	if u.cfg.MaxInFlight <= 0 {
+		return true
+	}
+	return atomic.LoadInt64(&u.inFlight) < int64(u.cfg.MaxInFlight)
+}
+
+// healthyUpstreams returns the currently healthy, under-capacity upstreams,
+// excluding any in excl.
+func (p *Pool) healthyUpstreams(excl map[string]bool) []*upstream {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var out []*upstream
+	for _, u := range p.upstreams {
+		if excl[u.cfg.Name] {
+			continue
+		}
+		if u.isHealthy() && u.underCapacity() {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// selectWeighted picks one upstream using weighted random selection: over
+// many requests each upstream's share of traffic converges to its weight,
+// without needing shared mutable cursor state. Successive picks do not
+// follow a fixed rotation.
+func selectWeighted(candidates []*upstream) *upstream {
+	if len(candidates) == 0 {
+		return nil
+	}
+	total := 0
+	for _, u := range candidates {
+		total += u.cfg.Weight
+	}
+	r := rand.Intn(total)
+	for _, u := range candidates {
+		if r < u.cfg.Weight {
+			return u
+		}
+		r -= u.cfg.Weight
+	}
+	return candidates[len(candidates)-1]
+}
+
+// httpClient returns the client to use for an outbound call: the streaming
+// client has no timeout, since an SSE response may stay open indefinitely.
+func (p *Pool) httpClient(streaming bool) *http.Client {
+	if streaming {
+		return p.streamClient
+	}
+	return p.client
+}
+
+// Dispatch selects a healthy upstream, attempting up to the pool's retry
+// budget against other healthy peers if it returns a 5xx or fails outright.
+// fn is called once per attempt with the chosen upstream.
+func (p *Pool) Dispatch(fn func(u *upstream) (*http.Response, error)) (*http.Response, *upstream, error) {
+	tried := map[string]bool{}
+	var lastErr error
+
+	attempts := p.retryBudget + 1
+	for i := 0; i < attempts; i++ {
+		candidates := p.healthyUpstreams(tried)
+		u := selectWeighted(candidates)
+		if u == nil {
+			if lastErr != nil {
+				return nil, nil, lastErr
+			}
+			return nil, nil, fmt.Errorf("no healthy upstreams available")
+		}
+		tried[u.cfg.Name] = true
+
+		atomic.AddInt64(&u.inFlight, 1)
+		resp, err := fn(u)
+		atomic.AddInt64(&u.inFlight, -1)
+
+		if err != nil {
+			lastErr = err
+			// A key-pool-exhausted upstream isn't unhealthy, just out of
+			// quota right now; don't let it contribute to health/backoff.
+			if !errors.Is(err, errKeyPoolExhausted) {
+				u.markUnhealthy(err)
+			}
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			lastErr = fmt.Errorf("upstream %s returned status %d", u.cfg.Name, resp.StatusCode)
+			u.markUnhealthy(lastErr)
+			resp.Body.Close()
+			continue
+		}
+		return resp, u, nil
+	}
+	return nil, nil, lastErr
+}
+
+// HealthzHandler reports whether at least one upstream is currently healthy.
+func (p *Pool) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	anyHealthy := false
+	for _, u := range p.upstreams {
+		if u.isHealthy() {
+			anyHealthy = true
+			break
+		}
+	}
+	p.mu.RUnlock()
+	if !anyHealthy {
+		http.Error(w, "no healthy upstreams", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// PoolHandler reports per-upstream state: health, RTT and in-flight counts.
+func (p *Pool) PoolHandler(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	upstreams := append([]*upstream(nil), p.upstreams...)
+	p.mu.RUnlock()
+
+	report := make([]map[string]interface{}, 0, len(upstreams))
+	for _, u := range upstreams {
+		report = append(report, u.snapshot())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"upstreams": report}); err != nil {
+		log.Printf("Error encoding pool report: %v", err)
+	}
+}
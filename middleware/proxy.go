@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
@@ -8,70 +11,320 @@ import (
 	"time"
 )
 
-func createLLMProxyHandler(targetURL string, validApiKey string) http.HandlerFunc {
+// streamCopyBufSize is deliberately small so each read/flush cycle forwards
+// an SSE frame to the client with minimal added latency.
+const streamCopyBufSize = 4 * 1024
+
+// isJSONContentType reports whether a Content-Type header names a JSON
+// body; the transform pipeline only ever touches those, leaving binary
+// uploads (audio, images) as pure pass-through.
+func isJSONContentType(contentType string) bool {
+	return strings.Contains(contentType, "application/json")
+}
+
+// isStreamingRequest reports whether the client asked for a streaming
+// completion, either via the OpenAI-style `"stream": true` body field or an
+// explicit SSE Accept header.
+func isStreamingRequest(r *http.Request, body []byte) bool {
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return true
+	}
+	var payload struct {
+		Stream bool `json:"stream"`
+	}
+	if json.Unmarshal(body, &payload) == nil && payload.Stream {
+		return true
+	}
+	return false
+}
+
+// isStreamingResponse reports whether the upstream is sending back an SSE or
+// chunked body that should be flushed to the client as it arrives rather
+// than buffered.
+func isStreamingResponse(resp *http.Response) bool {
+	if strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return true
+	}
+	for _, enc := range resp.TransferEncoding {
+		if enc == "chunked" {
+			return true
+		}
+	}
+	return false
+}
+
+// copyStreaming copies src to dst, flushing after every read so the caller
+// receives each chunk as soon as it arrives instead of waiting for src to
+// close. If onUsage is non-nil, each `data: {...}` frame is inspected for a
+// `usage` block (present on the final chunk of an OpenAI-style stream); the
+// last one seen before the stream ends is reported.
+func copyStreaming(w http.ResponseWriter, src io.Reader, onUsage func(model string, input, output int)) error {
+	flusher, ok := w.(http.Flusher)
+	var lineBuf bytes.Buffer
+
+	var lastModel string
+	var lastInput, lastOutput int
+	var sawUsage bool
+	if onUsage != nil {
+		defer func() {
+			if sawUsage {
+				onUsage(lastModel, lastInput, lastOutput)
+			}
+		}()
+	}
+
+	buf := make([]byte, streamCopyBufSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			chunk := buf[:n]
+			if _, werr := w.Write(chunk); werr != nil {
+				return werr
+			}
+			if ok {
+				flusher.Flush()
+			}
+			if onUsage != nil {
+				lineBuf.Write(chunk)
+				scanSSEUsage(&lineBuf, func(model string, input, output int) {
+					lastModel, lastInput, lastOutput, sawUsage = model, input, output, true
+				})
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// scanSSEUsage consumes complete lines from lineBuf, reporting the usage
+// block from any `data: ` frame it finds and leaving a trailing partial
+// line (if any) in the buffer for the next read.
+func scanSSEUsage(lineBuf *bytes.Buffer, onUsage func(model string, input, output int)) {
+	for {
+		line, err := lineBuf.ReadString('\n')
+		if err != nil {
+			// Incomplete line; put it back for the next chunk.
+			lineBuf.Reset()
+			lineBuf.WriteString(line)
+			return
+		}
+		data := strings.TrimPrefix(strings.TrimSpace(line), "data: ")
+		if data == "" || data == "[DONE]" {
+			continue
+		}
+		if model, input, output, ok := parseUsage([]byte(data)); ok {
+			onUsage(model, input, output)
+		}
+	}
+}
+
+// recordUsage debits the client's token bucket and updates the Prometheus
+// counters once a response's true token cost is known.
+func recordUsage(limiter *RateLimiter, metrics *Metrics, clientKey ClientKey, model string, input, output int) {
+	limiter.DebitTokens(clientKey, input+output)
+	metrics.RecordUsage(clientKey.Identity, model, "input", input)
+	metrics.RecordUsage(clientKey.Identity, model, "output", output)
+}
+
+// createLLMProxyHandler returns a handler that authenticates the caller,
+// picks a healthy upstream from pool (retrying on failure per its retry
+// budget), and streams the response back.
+func createLLMProxyHandler(pool *Pool, keyring *ClientKeyring, limiter *RateLimiter, metrics *Metrics, cache ResponseCache, cacheTTL time.Duration) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		startTime := time.Now()
 		log.Printf("Received request: %s %s", r.Method, r.URL.Path)
 
 		// API key authentication
 		apiKey := r.Header.Get("X-API-Key")
-		if apiKey != validApiKey {
+		clientKey, ok := keyring.Authenticate(apiKey)
+		if !ok {
 			log.Printf("Authentication failed: Invalid API key")
 			http.Error(w, "Unauthorizedg", http.StatusUnauthorized)
 			return
 		}
 
-		// Create a new proxy request
-		proxyPath := strings.TrimPrefix(r.URL.Path, "/api/llm")
+		if allowed, limitHeaders := limiter.Allow(clientKey); !allowed {
+			for name, values := range limitHeaders {
+				for _, v := range values {
+					w.Header().Add(name, v)
+				}
+			}
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
 
-		log.Printf("Proxying request to: %s", proxyPath)
-		proxyURL := targetURL + proxyPath
+		proxyPath := strings.TrimPrefix(r.URL.Path, "/api/llm")
+		log.Printf("Proxying request to: %s on behalf of %s", proxyPath, clientKey.Identity)
 
-		proxyReq, err := http.NewRequest(r.Method, proxyURL, r.Body)
+		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			log.Printf("Error creating proxy request: %v", err)
+			log.Printf("Error reading request body: %v", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 
-		// Copy headers from the original request
-		for name, values := range r.Header {
-			// Skip the API key header so it doesn't get forwarded to the LLM API
-			if name != "X-API-Key" {
+		if !clientKey.modelAllowed(body) {
+			log.Printf("Rejected request from %s: model not in allowed list", clientKey.Identity)
+			http.Error(w, "Forbidden: model not permitted for this key", http.StatusForbidden)
+			return
+		}
+
+		// Only JSON chat/completions bodies go through the transform
+		// pipeline; binary uploads (audio, images) pass through untouched.
+		if isJSONContentType(r.Header.Get("Content-Type")) {
+			body, err = clientKey.Transform.ApplyRequest(body)
+			if err != nil {
+				log.Printf("Error applying request transform: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		streaming := isStreamingRequest(r, body)
+		client := pool.httpClient(streaming)
+
+		cacheable := cache != nil && !streaming && isCacheablePath(proxyPath) && wantsCache(r, body)
+		var key string
+		if cacheable {
+			var ok bool
+			key, ok = cacheKey(proxyPath, body)
+			cacheable = ok
+		}
+		if cacheable {
+			if entry, hit := cache.Get(key); hit {
+				recordUsage(limiter, metrics, clientKey, entry.Model, entry.InputTokens, entry.OutputTokens)
+				w.Header().Set("Content-Type", entry.ContentType)
+				w.Header().Set("X-Cache", "HIT")
+				w.Write(entry.Body)
+				log.Printf("Cache hit for %s on behalf of %s", proxyPath, clientKey.Identity)
+				return
+			}
+		}
+
+		resp, u, err := pool.Dispatch(func(u *upstream) (*http.Response, error) {
+			proxyReq, err := http.NewRequest(r.Method, u.cfg.BaseURL+proxyPath, bytes.NewReader(body))
+			if err != nil {
+				return nil, err
+			}
+			// Cancel the upstream request if the client disconnects.
+			proxyReq = proxyReq.WithContext(r.Context())
+
+			// Copy headers from the original request.
+			for name, values := range r.Header {
+				// Skip the API key header so it doesn't get forwarded to the LLM API.
+				if name == http.CanonicalHeaderKey("X-API-Key") {
+					continue
+				}
 				for _, value := range values {
 					proxyReq.Header.Add(name, value)
 				}
 			}
-		}
+			// Apply the upstream's own auth headers on top.
+			for name, value := range u.cfg.Headers {
+				proxyReq.Header.Set(name, value)
+			}
 
-		// Send the proxy request
-		client := &http.Client{}
-		resp, err := client.Do(proxyReq)
+			// If this upstream rotates provider keys, pick one for this
+			// attempt and cool it down if the upstream rejects it.
+			var keyState *providerKeyState
+			if u.keys != nil {
+				keyState, err = u.keys.Next()
+				if err != nil {
+					return nil, err
+				}
+				proxyReq.Header.Set(u.cfg.AuthHeader, u.authHeaderValue(keyState.Key))
+			} else if u.cfg.APIKey != "" {
+				proxyReq.Header.Set(u.cfg.AuthHeader, u.authHeaderValue(u.cfg.APIKey))
+			}
+
+			resp, err := client.Do(proxyReq)
+			if err == nil && keyState != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusTooManyRequests) {
+				u.keys.CoolDown(keyState, keyCoolDown)
+			}
+			return resp, err
+		})
 		if err != nil {
 			log.Printf("Error in proxy request: %v", err)
+			if errors.Is(err, errKeyPoolExhausted) {
+				http.Error(w, "Too Many Requests: upstream provider keys exhausted", http.StatusTooManyRequests)
+				return
+			}
 			http.Error(w, "Bad Gateway", http.StatusBadGateway)
 			return
 		}
 		defer resp.Body.Close()
 
-		// Copy the response headers
+		streamingResp := isStreamingResponse(resp)
+		bufferJSONResponse := !streamingResp && isJSONContentType(resp.Header.Get("Content-Type"))
+
+		var respBody []byte
+		if bufferJSONResponse {
+			respBody, err = io.ReadAll(resp.Body)
+			if err != nil {
+				log.Printf("Error reading response body: %v", err)
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				return
+			}
+			model, input, output, usageOK := parseUsage(respBody)
+			if usageOK {
+				recordUsage(limiter, metrics, clientKey, model, input, output)
+			}
+			respBody, err = clientKey.Transform.ApplyResponse(respBody)
+			if err != nil {
+				log.Printf("Error applying response transform: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+
+			if cacheable && resp.StatusCode == http.StatusOK {
+				// Reuse the usage parsed above, from the pre-transform body:
+				// strip_response_fields can remove usage/model, which would
+				// otherwise zero out recordUsage on every future cache hit.
+				cache.Set(key, &CacheEntry{
+					Body:         respBody,
+					ContentType:  resp.Header.Get("Content-Type"),
+					Model:        model,
+					InputTokens:  input,
+					OutputTokens: output,
+				}, cacheTTL)
+			}
+		}
+
+		// Copy the response headers.
 		for name, values := range resp.Header {
+			if bufferJSONResponse && name == "Content-Length" {
+				continue // the transformed body may be a different length
+			}
 			for _, value := range values {
 				w.Header().Add(name, value)
 			}
 		}
-
-		// Set the status code
+		if cacheable {
+			w.Header().Set("X-Cache", "MISS")
+		}
 		w.WriteHeader(resp.StatusCode)
 
-		// Copy the response body
-		_, err = io.Copy(w, resp.Body)
-		if err != nil {
-			log.Printf("Error copying response body: %v", err)
+		var copyErr error
+		switch {
+		case bufferJSONResponse:
+			_, copyErr = w.Write(respBody)
+		case streamingResp:
+			copyErr = copyStreaming(w, resp.Body, func(model string, input, output int) {
+				recordUsage(limiter, metrics, clientKey, model, input, output)
+			})
+		default:
+			_, copyErr = io.Copy(w, resp.Body)
+		}
+		if copyErr != nil {
+			log.Printf("Error copying response body: %v", copyErr)
 			return
 		}
 
 		elapsed := time.Since(startTime)
-		log.Printf("Request completed in %v with status %d", elapsed, resp.StatusCode)
+		log.Printf("Request completed in %v via %s with status %d", elapsed, u.cfg.Name, resp.StatusCode)
 	}
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingFlusher captures each Write call separately (instead of letting
+// httptest.ResponseRecorder coalesce them) so the test can assert that SSE
+// frames arrived as distinct writes rather than one buffered blob.
+type recordingFlusher struct {
+	header http.Header
+
+	mu     sync.Mutex
+	writes []string
+}
+
+func newRecordingFlusher() *recordingFlusher {
+	return &recordingFlusher{header: make(http.Header)}
+}
+
+func (f *recordingFlusher) Header() http.Header { return f.header }
+
+func (f *recordingFlusher) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writes = append(f.writes, string(p))
+	return len(p), nil
+}
+
+func (f *recordingFlusher) WriteHeader(int) {}
+
+func (f *recordingFlusher) Flush() {}
+
+func (f *recordingFlusher) snapshot() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]string, len(f.writes))
+	copy(out, f.writes)
+	return out
+}
+
+// TestCopyStreamingForwardsFramesIndividually spins up an httptest server
+// that emits SSE frames with a delay and a Flush between each one, then
+// asserts copyStreaming relays each frame as its own Write (not buffered
+// until the stream closes).
+func TestCopyStreamingForwardsFramesIndividually(t *testing.T) {
+	frames := []string{"frame-1", "frame-2", "frame-3"}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		flusher := w.(http.Flusher)
+		for _, f := range frames {
+			fmt.Fprintf(w, "data: %s\n\n", f)
+			flusher.Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET upstream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	rf := newRecordingFlusher()
+	var usageCalls int
+	if err := copyStreaming(rf, resp.Body, func(model string, input, output int) {
+		usageCalls++
+	}); err != nil {
+		t.Fatalf("copyStreaming: %v", err)
+	}
+
+	writes := rf.snapshot()
+	if len(writes) < len(frames) {
+		t.Fatalf("expected at least %d separate writes (one per frame), got %d: %v", len(frames), len(writes), writes)
+	}
+
+	joined := ""
+	for _, w := range writes {
+		joined += w
+	}
+	for _, f := range frames {
+		if !strings.Contains(joined, "data: "+f) {
+			t.Errorf("frame %q missing from forwarded output %q", f, joined)
+		}
+	}
+
+	if usageCalls != 0 {
+		t.Errorf("expected no usage callbacks for frames without a usage block, got %d", usageCalls)
+	}
+}
+
+// TestScanSSEUsageFindsFinalUsageBlock asserts the usage block on the last
+// SSE frame before [DONE] is reported, matching the OpenAI streaming shape.
+func TestScanSSEUsageFindsFinalUsageBlock(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		flusher := w.(http.Flusher)
+		fmt.Fprint(w, "data: {\"model\":\"gpt-4o-mini\",\"choices\":[]}\n\n")
+		flusher.Flush()
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprint(w, "data: {\"model\":\"gpt-4o-mini\",\"usage\":{\"prompt_tokens\":12,\"completion_tokens\":34}}\n\n")
+		flusher.Flush()
+		fmt.Fprint(w, "data: [DONE]\n\n")
+		flusher.Flush()
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET upstream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var gotModel string
+	var gotInput, gotOutput int
+	var calls int
+	rf := newRecordingFlusher()
+	if err := copyStreaming(rf, resp.Body, func(model string, input, output int) {
+		calls++
+		gotModel, gotInput, gotOutput = model, input, output
+	}); err != nil {
+		t.Fatalf("copyStreaming: %v", err)
+	}
+
+	if calls != 1 {
+		t.Fatalf("expected exactly 1 usage callback, got %d", calls)
+	}
+	if gotModel != "gpt-4o-mini" || gotInput != 12 || gotOutput != 34 {
+		t.Errorf("unexpected usage: model=%s input=%d output=%d", gotModel, gotInput, gotOutput)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a classic leaky bucket: capacity tokens, refilled
+// continuously at refillPerSec, consumed by tryTake/debit. debit is allowed
+// to push tokens negative (debt), which simply means the bucket takes
+// longer to refill back above zero before the next request is admitted.
+type tokenBucket struct {
+	mu           sync.Mutex
+	capacity     float64
+	tokens       float64
+	refillPerSec float64
+	last         time.Time
+}
+
+func newTokenBucket(capacity, refillPerSec float64) *tokenBucket {
+	return &tokenBucket{capacity: capacity, tokens: capacity, refillPerSec: refillPerSec, last: time.Now()}
+}
+
+func (b *tokenBucket) refillLocked(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens = math.Min(b.capacity, b.tokens+elapsed*b.refillPerSec)
+	b.last = now
+}
+
+// tryTake reports whether n tokens are available right now; if not, it
+// returns how long the caller should wait before retrying.
+func (b *tokenBucket) tryTake(n float64) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.refillLocked(now)
+	if b.tokens >= n {
+		b.tokens -= n
+		return true, 0
+	}
+	deficit := n - b.tokens
+	retryAfter := time.Duration(deficit/b.refillPerSec*1000) * time.Millisecond
+	return false, retryAfter
+}
+
+// debit removes n tokens after the fact (used once the true token cost of a
+// completion is known), allowing the bucket to go into debt.
+func (b *tokenBucket) debit(n float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked(time.Now())
+	b.tokens -= n
+}
+
+func (b *tokenBucket) remaining() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked(time.Now())
+	return b.tokens
+}
+
+// clientLimiter holds the per-client-key request-rate and token-rate buckets.
+type clientLimiter struct {
+	requests *tokenBucket
+	tokens   *tokenBucket
+}
+
+const (
+	defaultRequestsPerMin = 60
+	defaultTokensPerMin   = 60000
+)
+
+// RateLimiter tracks one clientLimiter per authenticated client key (keyed
+// by ClientKey.Key, so two keys sharing an Identity are limited separately).
+type RateLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*clientLimiter
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{limiters: make(map[string]*clientLimiter)}
+}
+
+func (rl *RateLimiter) limiterFor(ck ClientKey) *clientLimiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if cl, ok := rl.limiters[ck.Key]; ok {
+		return cl
+	}
+
+	reqPerMin := float64(ck.RequestsPerMin)
+	if reqPerMin <= 0 {
+		reqPerMin = defaultRequestsPerMin
+	}
+	tokensPerMin := float64(ck.TokensPerMin)
+	if tokensPerMin <= 0 {
+		tokensPerMin = defaultTokensPerMin
+	}
+
+	cl := &clientLimiter{
+		requests: newTokenBucket(reqPerMin, reqPerMin/60),
+		tokens:   newTokenBucket(tokensPerMin, tokensPerMin/60),
+	}
+	rl.limiters[ck.Key] = cl
+	return cl
+}
+
+// Allow admits or rejects a request for ck, checking both the
+// requests-per-minute bucket and that the token bucket isn't already
+// empty/in debt. On rejection it returns the headers the caller should set
+// alongside a 429.
+func (rl *RateLimiter) Allow(ck ClientKey) (bool, http.Header) {
+	cl := rl.limiterFor(ck)
+
+	// Check the token bucket first, without consuming from either bucket:
+	// a request rejected for being out of TPM budget shouldn't also cost
+	// the caller an RPM slot it would otherwise have kept.
+	if remaining := cl.tokens.remaining(); remaining <= 0 {
+		retryAfter := time.Duration(-remaining/cl.tokens.refillPerSec*1000) * time.Millisecond
+		return false, rateLimitHeaders(retryAfter, cl)
+	}
+	if ok, retryAfter := cl.requests.tryTake(1); !ok {
+		return false, rateLimitHeaders(retryAfter, cl)
+	}
+	return true, nil
+}
+
+// DebitTokens records the true token cost of a completion against ck's
+// token bucket once the response is known.
+func (rl *RateLimiter) DebitTokens(ck ClientKey, n int) {
+	if n <= 0 {
+		return
+	}
+	rl.limiterFor(ck).tokens.debit(float64(n))
+}
+
+func rateLimitHeaders(retryAfter time.Duration, cl *clientLimiter) http.Header {
+	h := http.Header{}
+	secs := int(math.Ceil(retryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	h.Set("Retry-After", strconv.Itoa(secs))
+	h.Set("X-RateLimit-Limit-Requests", fmt.Sprintf("%.0f", cl.requests.capacity))
+	h.Set("X-RateLimit-Remaining-Requests", fmt.Sprintf("%.0f", cl.requests.remaining()))
+	h.Set("X-RateLimit-Limit-Tokens", fmt.Sprintf("%.0f", cl.tokens.capacity))
+	h.Set("X-RateLimit-Remaining-Tokens", fmt.Sprintf("%.0f", math.Max(0, cl.tokens.remaining())))
+	return h
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+)
+
+// TransformConfig describes the request/response rewrites to apply for one
+// client key. Every field is optional; a zero value leaves that aspect of
+// the request/response untouched.
+type TransformConfig struct {
+	// Request-side.
+	InjectSystemPrompt string            `json:"inject_system_prompt,omitempty"`
+	ModelRemap         map[string]string `json:"model_remap,omitempty"`
+	MaxTokens          int               `json:"max_tokens,omitempty"` // clamps `max_tokens` down, never up
+	ForceStreamFalse   bool              `json:"force_stream_false,omitempty"`
+	StripParams        []string          `json:"strip_params,omitempty"`
+	RedactPatterns     []string          `json:"redact_patterns,omitempty"` // regexes applied to messages[].content
+
+	// Response-side.
+	ResponseModelRemap  map[string]string `json:"response_model_remap,omitempty"`
+	StripResponseFields []string          `json:"strip_response_fields,omitempty"`
+
+	redact []*regexp.Regexp // compiled by compile() when the key is loaded or added
+}
+
+// compile precompiles RedactPatterns. Call once after loading config.
+func (t *TransformConfig) compile() error {
+	if t == nil {
+		return nil
+	}
+	t.redact = make([]*regexp.Regexp, 0, len(t.RedactPatterns))
+	for _, pat := range t.RedactPatterns {
+		re, err := regexp.Compile(pat)
+		if err != nil {
+			return err
+		}
+		t.redact = append(t.redact, re)
+	}
+	return nil
+}
+
+const redactedPlaceholder = "[REDACTED]"
+
+// ApplyRequest rewrites a chat/completions-style JSON body in place,
+// returning the transformed bytes. Non-JSON bodies (audio/image uploads)
+// must never reach here; callers should check Content-Type first and pass
+// those straight through unmodified.
+func (t *TransformConfig) ApplyRequest(body []byte) ([]byte, error) {
+	if t == nil {
+		return body, nil
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return body, nil // not a JSON object we recognize; pass through
+	}
+
+	if t.InjectSystemPrompt != "" {
+		injectSystemPrompt(payload, t.InjectSystemPrompt)
+	}
+	if newModel, ok := t.ModelRemap[stringField(payload, "model")]; ok {
+		payload["model"] = newModel
+	}
+	if t.MaxTokens > 0 {
+		clampIntField(payload, "max_tokens", t.MaxTokens)
+	}
+	if t.ForceStreamFalse {
+		payload["stream"] = false
+	}
+	for _, field := range t.StripParams {
+		delete(payload, field)
+	}
+	for _, re := range t.redact {
+		redactMessages(payload, re)
+	}
+
+	return json.Marshal(payload)
+}
+
+// ApplyResponse rewrites a chat/completions-style JSON response body,
+// remapping the reported model back to what the caller originally asked for
+// and stripping any vendor-specific fields the operator doesn't want to
+// leak downstream.
+func (t *TransformConfig) ApplyResponse(body []byte) ([]byte, error) {
+	if t == nil {
+		return body, nil
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return body, nil
+	}
+
+	if newModel, ok := t.ResponseModelRemap[stringField(payload, "model")]; ok {
+		payload["model"] = newModel
+	}
+	for _, field := range t.StripResponseFields {
+		delete(payload, field)
+	}
+
+	return json.Marshal(payload)
+}
+
+func stringField(payload map[string]interface{}, key string) string {
+	s, _ := payload[key].(string)
+	return s
+}
+
+// clampIntField caps payload[key] at max, returning true if it changed it.
+// JSON numbers decode as float64, so the comparison happens in that space.
+func clampIntField(payload map[string]interface{}, key string, max int) bool {
+	v, ok := payload[key].(float64)
+	if !ok || v <= float64(max) {
+		return false
+	}
+	payload[key] = max
+	return true
+}
+
+// injectSystemPrompt prepends a system message, or creates the messages
+// array if the request didn't have one (e.g. the legacy completions API).
+func injectSystemPrompt(payload map[string]interface{}, prompt string) {
+	systemMsg := map[string]interface{}{"role": "system", "content": prompt}
+
+	messages, ok := payload["messages"].([]interface{})
+	if !ok {
+		payload["messages"] = []interface{}{systemMsg}
+		return
+	}
+	payload["messages"] = append([]interface{}{systemMsg}, messages...)
+}
+
+// redactMessages applies re to every messages[].content string, replacing
+// matches with redactedPlaceholder.
+func redactMessages(payload map[string]interface{}, re *regexp.Regexp) {
+	messages, ok := payload["messages"].([]interface{})
+	if !ok {
+		return
+	}
+	for _, m := range messages {
+		msg, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		content, ok := msg["content"].(string)
+		if !ok {
+			continue
+		}
+		msg["content"] = re.ReplaceAllString(content, redactedPlaceholder)
+	}
+}
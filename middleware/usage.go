@@ -0,0 +1,30 @@
+package main
+
+import "encoding/json"
+
+// usagePayload covers both the OpenAI (`prompt_tokens`/`completion_tokens`)
+// and Anthropic (`input_tokens`/`output_tokens`) shapes of a `usage` block.
+type usagePayload struct {
+	Model string `json:"model"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		InputTokens      int `json:"input_tokens"`
+		OutputTokens     int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+// parseUsage extracts the model name and input/output token counts from a
+// chat/completions-style JSON body. ok is false if body has no usage block.
+func parseUsage(body []byte) (model string, input, output int, ok bool) {
+	var p usagePayload
+	if json.Unmarshal(body, &p) != nil {
+		return "", 0, 0, false
+	}
+	input = p.Usage.PromptTokens + p.Usage.InputTokens
+	output = p.Usage.CompletionTokens + p.Usage.OutputTokens
+	if input == 0 && output == 0 {
+		return "", 0, 0, false
+	}
+	return p.Model, input, output, true
+}